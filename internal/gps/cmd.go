@@ -8,22 +8,59 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Masterminds/vcs"
+	"github.com/golang/dep/internal/gps/internal/wpool"
 )
 
+// defaultKillDelay is the default grace period given to a subprocess to exit
+// on its own, after being sent InterruptSignal, before it is forcibly killed.
+//
+// This gives git/hg/bzr a chance to clean up lockfiles (e.g. .git/index.lock)
+// instead of leaving them behind for the next invocation to choke on.
+const defaultKillDelay = 2 * time.Second
+
 // monitoredCmd wraps a cmd and will keep monitoring the process until it
 // finishes, the provided context is canceled, or a certain amount of time has
 // passed and the command showed no signs of activity.
 type monitoredCmd struct {
 	cmd     *exec.Cmd
 	timeout time.Duration
-	stdout  *activityBuffer
-	stderr  *activityBuffer
+
+	// output is the capped, shared buffer backing both cmd.Stdout and
+	// cmd.Stderr. Using a single buffer for both streams, rather than one
+	// each, is what makes combinedOutput's result a real interleaving of the
+	// two rather than a concatenation of them.
+	output *activityBuffer
+
+	// InterruptSignal is the signal sent to ask the subprocess to shut down
+	// gracefully before KillDelay elapses and it is forcibly killed. It
+	// defaults to os.Interrupt on platforms that support it.
+	InterruptSignal os.Signal
+	// KillDelay is how long to wait after sending InterruptSignal before
+	// escalating to os.Kill. It defaults to defaultKillDelay.
+	KillDelay time.Duration
+
+	// ProcessGroup controls whether the subprocess is placed in its own
+	// process group (Unix) or Job Object (Windows), so that signaling or
+	// killing it also reaps any helper processes it spawned (ssh,
+	// askpass, credential helpers, and the like). It defaults to true;
+	// tests that need to observe the unadorned child process can disable
+	// it.
+	ProcessGroup bool
+
+	// progress and progressEvents back WithProgressHandler: streamWriter
+	// sends onto progressEvents as lines arrive, and a dedicated goroutine
+	// (started in monitor) drains it to call progress, so a slow progress
+	// handler can never block the subprocess's own output pipe.
+	progress       ProgressHandler
+	progressEvents chan ProgressEvent
 }
 
 // noProgressError indicates that the monitored process was terminated due to
@@ -38,31 +75,141 @@ type killCmdError struct {
 	err error
 }
 
+// ProgressEvent describes one line of output observed from a monitored
+// subprocess.
+type ProgressEvent struct {
+	// Stream is "stdout" or "stderr", identifying which pipe Line arrived on.
+	Stream string
+	// Bytes is the length of Line.
+	Bytes int
+	// Time is when the line was observed.
+	Time time.Time
+	// Line is the line's content, with its trailing newline (and any
+	// preceding carriage return) stripped.
+	Line string
+}
+
+// ProgressHandler is called with a ProgressEvent for lines a monitored
+// subprocess writes. See WithProgressHandler for delivery guarantees.
+type ProgressHandler func(ProgressEvent)
+
+// progressEventBuffer bounds the channel used to hand ProgressEvents from a
+// streamWriter to its monitoredCmd's dispatch goroutine. It's sized to
+// absorb a reasonable burst of output lines without the dispatch goroutine
+// needing to keep up instantaneously, while still bounding memory use if a
+// ProgressHandler falls permanently behind.
+const progressEventBuffer = 64
+
+// monitoredCmdOption configures optional behavior of a monitoredCmd created
+// via newMonitoredCmdWithOptions.
+type monitoredCmdOption func(*monitoredCmdOptions)
+
+type monitoredCmdOptions struct {
+	maxBuffer       int
+	stdoutTee       io.Writer
+	stderrTee       io.Writer
+	progressHandler ProgressHandler
+}
+
+// WithMaxBuffer caps the amount of subprocess output retained in memory to n
+// bytes, discarding the middle of the stream (while still updating the
+// activity timestamp used for progress-timeout detection) once it is
+// exceeded. A non-positive n, the default, leaves the buffer unbounded.
+func WithMaxBuffer(n int) monitoredCmdOption {
+	return func(o *monitoredCmdOptions) { o.maxBuffer = n }
+}
+
+// WithStdoutTee additionally streams everything the subprocess writes to
+// stdout to w, as it's written, alongside the normal buffering.
+func WithStdoutTee(w io.Writer) monitoredCmdOption {
+	return func(o *monitoredCmdOptions) { o.stdoutTee = w }
+}
+
+// WithStderrTee additionally streams everything the subprocess writes to
+// stderr to w, as it's written, alongside the normal buffering.
+func WithStderrTee(w io.Writer) monitoredCmdOption {
+	return func(o *monitoredCmdOptions) { o.stderrTee = w }
+}
+
+// WithProgressHandler registers h to be called with a ProgressEvent for
+// newline-terminated lines the subprocess writes to stdout or stderr, letting
+// callers surface real progress (e.g. git's "Receiving objects: 42%") instead
+// of just watching for silence. h runs on its own goroutine, decoupled from
+// the subprocess's output pipe, so a slow or blocking h cannot stall the
+// subprocess itself. Events reach h through a channel holding at most
+// progressEventBuffer of them; lines that arrive while it is full are
+// dropped, so h does not necessarily see every line. A final line with no
+// trailing newline is never reported.
+//
+// Nothing in this tree calls WithProgressHandler yet: runFromRepoDir doesn't
+// have a gps.Source or gps.ProgressAnalyzer to forward events to, since
+// neither exists here. That wiring belongs in the source-manager code that
+// currently lives outside this package.
+func WithProgressHandler(h ProgressHandler) monitoredCmdOption {
+	return func(o *monitoredCmdOptions) { o.progressHandler = h }
+}
+
 func newMonitoredCmd(cmd *exec.Cmd, timeout time.Duration) *monitoredCmd {
-	stdout, stderr := newActivityBuffer(), newActivityBuffer()
-	cmd.Stdout, cmd.Stderr = stdout, stderr
+	return newMonitoredCmdWithOptions(cmd, timeout)
+}
+
+func newMonitoredCmdWithOptions(cmd *exec.Cmd, timeout time.Duration, opts ...monitoredCmdOption) *monitoredCmd {
+	var o monitoredCmdOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var events chan ProgressEvent
+	if o.progressHandler != nil {
+		events = make(chan ProgressEvent, progressEventBuffer)
+	}
+
+	output := newActivityBuffer(o.maxBuffer)
+	cmd.Stdout = &streamWriter{buf: output, tee: o.stdoutTee, stream: "stdout", events: events}
+	cmd.Stderr = &streamWriter{buf: output, tee: o.stderrTee, stream: "stderr", events: events}
+
 	return &monitoredCmd{
-		cmd:     cmd,
-		timeout: timeout,
-		stdout:  stdout,
-		stderr:  stderr,
+		cmd:             cmd,
+		timeout:         timeout,
+		output:          output,
+		InterruptSignal: defaultInterruptSignal,
+		KillDelay:       defaultKillDelay,
+		ProcessGroup:    true,
+		progress:        o.progressHandler,
+		progressEvents:  events,
 	}
 }
 
 // run will wait for the command to finish and return the error, if any. If the
 // command does not show any progress, as indicated by writing to stdout or
 // stderr, for more than the specified timeout, the process will be killed.
+//
+// run allocates its own ticker for progress-timeout polling, with a period
+// derived from c.timeout. runWithTick instead polls on a ticker channel
+// supplied by its caller; the VCS worker pool supplies each task with its own
+// ticker at the pool's fixed interval, so tickers are not shared between
+// in-flight commands.
 func (c *monitoredCmd) run(ctx context.Context) error {
 	// Check for cancellation before even starting
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
 
-	err := c.cmd.Start()
-	if err != nil {
+	if c.ProcessGroup {
+		configureProcessGroup(c.cmd)
+	}
+
+	if err := c.cmd.Start(); err != nil {
+		if c.ProcessGroup {
+			releaseProcessGroup(c.cmd)
+		}
 		return err
 	}
 
+	if c.ProcessGroup {
+		attachProcessGroup(c.cmd)
+	}
+
 	// With ticker-based timeout control, the maximum possible running time
 	// without progress is equal to timeout + ticker cycle - 1ns. As such, we
 	// want a shorter ticker cycle time than the timeout; setting them equally
@@ -92,6 +239,49 @@ func (c *monitoredCmd) run(ctx context.Context) error {
 	ticker := time.NewTicker(tickDuration)
 	defer ticker.Stop()
 
+	return c.monitor(ctx, ticker.C)
+}
+
+// runWithTick is the wpool-facing counterpart to run: the process is started
+// exactly as run does, but progress-timeout polling rides on tick, a ticker
+// channel supplied by the caller (wpool gives each task its own, at the
+// pool's fixed interval), rather than a ticker run derives from c.timeout.
+func (c *monitoredCmd) runWithTick(ctx context.Context, tick <-chan time.Time) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if c.ProcessGroup {
+		configureProcessGroup(c.cmd)
+	}
+
+	if err := c.cmd.Start(); err != nil {
+		if c.ProcessGroup {
+			releaseProcessGroup(c.cmd)
+		}
+		return err
+	}
+
+	if c.ProcessGroup {
+		attachProcessGroup(c.cmd)
+	}
+
+	return c.monitor(ctx, tick)
+}
+
+// monitor waits for c.cmd to finish, killing it - gracefully, then
+// forcibly - if ctx is canceled or tick indicates c.timeout has elapsed
+// without progress. c.cmd must already have been started.
+func (c *monitoredCmd) monitor(ctx context.Context, tick <-chan time.Time) error {
+	if c.ProcessGroup {
+		defer releaseProcessGroup(c.cmd)
+	}
+
+	if c.progressEvents != nil {
+		go c.dispatchProgress()
+		defer close(c.progressEvents)
+	}
+
 	// Atomic marker to track proc exit state. Guards against bad channel
 	// select receive order, where a tick or context cancellation could come
 	// in at the same time as process completion, but one of the former are
@@ -113,30 +303,40 @@ selloop:
 		select {
 		case err := <-done:
 			return err
-		case <-ticker.C:
+		case <-tick:
 			if !atomic.CompareAndSwapInt32(isDone, 1, 1) && c.hasTimedOut() {
-				if err := killProcess(c.cmd, isDone); err != nil {
+				drained, err := c.waitOrStop(isDone, done)
+				if err != nil {
 					killerr = &killCmdError{err}
 				} else {
 					killerr = &noProgressError{c.timeout}
 				}
+				if drained {
+					return killerr
+				}
 				break selloop
 			}
 		case <-ctx.Done():
 			if !atomic.CompareAndSwapInt32(isDone, 1, 1) {
-				if err := killProcess(c.cmd, isDone); err != nil {
+				drained, err := c.waitOrStop(isDone, done)
+				if err != nil {
 					killerr = &killCmdError{err}
 				} else {
 					killerr = ctx.Err()
 				}
+				if drained {
+					return killerr
+				}
 				break selloop
 			}
 		}
 	}
 
-	// This is only reachable on the signal-induced termination path, so block
-	// until a message comes through the channel indicating that the command has
-	// exited.
+	// waitOrStop did not itself receive cmd.Wait()'s result (that's what
+	// !drained means: it escalated to a hard kill, or found the process
+	// already done and sent nothing), so - unlike the
+	// graceful-exit case above, which already consumed the one and only
+	// value done will ever produce - we still need to block for it here.
 	//
 	// TODO(sdboyer) if the signaling process errored (resulting in a
 	// killCmdError stored in killerr), is it possible that this receive could
@@ -145,40 +345,195 @@ selloop:
 	return killerr
 }
 
+// waitOrStop is invoked once c's process is known to be hung or no longer
+// wanted (a progress timeout fired, or ctx was canceled). It attempts a
+// graceful shutdown by sending InterruptSignal and giving the process
+// KillDelay to exit on its own; only if that window elapses without the
+// process exiting does it escalate to an unconditional kill.
+//
+// This mirrors the approach taken by golang.org/x/playground's sandbox
+// runner, which has to deal with the same problem of giving arbitrary
+// subprocesses a chance to clean up (flush output, remove lockfiles) before
+// being killed outright.
+//
+// done is a single-send, size-1 channel fed by the same cmd.Wait() call
+// monitor itself waits on, so at most one of waitOrStop and monitor may ever
+// receive from it. waitOrStop reports via its drained return value whether
+// it was the one that did so, letting its caller know whether it still
+// needs to perform that receive itself.
+func (c *monitoredCmd) waitOrStop(isDone *int32, done <-chan error) (drained bool, err error) {
+	if c.cmd.Process == nil {
+		// Nothing was ever started; nothing to stop.
+		return false, nil
+	}
+
+	if c.InterruptSignal != nil {
+		var sigErr error
+		if c.ProcessGroup {
+			sigErr = signalProcessGroup(c.cmd, c.InterruptSignal)
+		} else {
+			sigErr = c.cmd.Process.Signal(c.InterruptSignal)
+		}
+		if sigErr == nil {
+			select {
+			case <-done:
+				atomic.CompareAndSwapInt32(isDone, 0, 1)
+				return true, nil
+			case <-time.After(c.KillDelay):
+				// The interrupt didn't take within the grace period; fall
+				// through to the hard kill below.
+			}
+		}
+		// Signaling failed outright (e.g. the process had already exited, or
+		// the platform doesn't support this signal); go straight to the kill.
+	}
+
+	if atomic.CompareAndSwapInt32(isDone, 1, 1) {
+		return false, nil
+	}
+	return false, killProcess(c.cmd, c.ProcessGroup)
+}
+
+// dispatchProgress drains c.progressEvents and invokes c.progress for each
+// one, off of the goroutines that copy the subprocess's stdout/stderr pipes.
+// It returns once c.progressEvents is closed.
+func (c *monitoredCmd) dispatchProgress() {
+	for ev := range c.progressEvents {
+		c.progress(ev)
+	}
+}
+
 func (c *monitoredCmd) hasTimedOut() bool {
 	t := time.Now().Add(-c.timeout)
-	return c.stderr.lastActivity().Before(t) &&
-		c.stdout.lastActivity().Before(t)
+	return c.output.lastActivity().Before(t)
 }
 
 func (c *monitoredCmd) combinedOutput(ctx context.Context) ([]byte, error) {
 	if err := c.run(ctx); err != nil {
-		return c.stderr.buf.Bytes(), err
+		return c.output.Bytes(), err
 	}
 
-	// FIXME(sdboyer) this is not actually combined output
-	return c.stdout.buf.Bytes(), nil
+	return c.output.Bytes(), nil
+}
+
+// combinedOutputPooled is combinedOutput's counterpart for commands run
+// through a wpool.Pool: it submits c as a task rather than running it
+// inline, so c is subject to the pool's concurrency limit and polls on the
+// ticker the pool provides for the task instead of allocating its own.
+func (c *monitoredCmd) combinedOutputPooled(ctx context.Context, pool *wpool.Pool) ([]byte, error) {
+	err := pool.Submit(wpool.Task{
+		Ctx: ctx,
+		Run: c.runWithTick,
+	})
+	if err != nil {
+		return c.output.Bytes(), err
+	}
+
+	return c.output.Bytes(), nil
+}
+
+// streamWriter is the io.Writer installed as a monitoredCmd's cmd.Stdout or
+// cmd.Stderr. It records into the shared activityBuffer backing both
+// streams - which is what makes their combined output a true interleaving
+// rather than a concatenation - tees the raw bytes to an additional
+// per-stream writer if configured, and, if events is non-nil, emits a
+// ProgressEvent for each complete line it sees.
+//
+// streamWriter is not safe for concurrent use, but doesn't need to be: cmd
+// only ever calls Write for a given stream from the single goroutine it
+// dedicates to copying that stream's pipe.
+type streamWriter struct {
+	buf    *activityBuffer
+	tee    io.Writer
+	stream string
+	events chan<- ProgressEvent
+
+	pending []byte // bytes of an as-yet-incomplete line
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.tee != nil {
+		// Best-effort: a broken or slow tee must not stop us from recording
+		// the subprocess's output or detecting its progress.
+		w.tee.Write(p)
+	}
+	if w.events != nil {
+		w.emitLines(p)
+	}
+	return w.buf.Write(p)
+}
+
+// emitLines scans p for newline-terminated lines, carrying any trailing
+// partial line over to the next Write call, and emits a ProgressEvent for
+// each complete line onto w.events. The send is non-blocking: if the
+// consuming goroutine has fallen behind and the bounded channel is full, the
+// event is dropped rather than stalling this Write call - and, with it, the
+// subprocess's own output pipe.
+func (w *streamWriter) emitLines(p []byte) {
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimRight(w.pending[:i], "\r"))
+		w.pending = w.pending[i+1:]
+
+		select {
+		case w.events <- ProgressEvent{Stream: w.stream, Bytes: len(line), Time: time.Now(), Line: line}:
+		default:
+		}
+	}
 }
 
 // activityBuffer is a buffer that keeps track of the last time a Write
-// operation was performed on it.
+// operation was performed on it. Once more than maxBuffer bytes have been
+// written to it, it discards data from the middle of the stream, retaining
+// only the head and tail - enough to diagnose a hung or runaway VCS command
+// without holding its entire, potentially enormous, output in memory.
 type activityBuffer struct {
 	sync.Mutex
-	buf               *bytes.Buffer
+	maxBuffer         int // <= 0 means unbounded
+	head              bytes.Buffer
+	tail              bytes.Buffer
+	truncated         bool
 	lastActivityStamp time.Time
 }
 
-func newActivityBuffer() *activityBuffer {
-	return &activityBuffer{
-		buf: bytes.NewBuffer(nil),
-	}
+func newActivityBuffer(maxBuffer int) *activityBuffer {
+	return &activityBuffer{maxBuffer: maxBuffer}
 }
 
 func (b *activityBuffer) Write(p []byte) (int, error) {
 	b.Lock()
-	b.lastActivityStamp = time.Now()
 	defer b.Unlock()
-	return b.buf.Write(p)
+	b.lastActivityStamp = time.Now()
+
+	n := len(p)
+	if b.maxBuffer <= 0 {
+		b.tail.Write(p)
+		return n, nil
+	}
+
+	headCap := b.maxBuffer / 2
+	if b.head.Len() < headCap {
+		fill := headCap - b.head.Len()
+		if fill > len(p) {
+			fill = len(p)
+		}
+		b.head.Write(p[:fill])
+		p = p[fill:]
+	}
+
+	if len(p) > 0 {
+		tailCap := b.maxBuffer - headCap
+		b.tail.Write(p)
+		if excess := b.tail.Len() - tailCap; excess > 0 {
+			b.tail.Next(excess)
+			b.truncated = true
+		}
+	}
+	return n, nil
 }
 
 func (b *activityBuffer) lastActivity() time.Time {
@@ -187,6 +542,27 @@ func (b *activityBuffer) lastActivity() time.Time {
 	return b.lastActivityStamp
 }
 
+// Bytes returns the output collected so far. If the stream exceeded
+// maxBuffer, the elided middle section is replaced with a marker noting that
+// truncation occurred.
+func (b *activityBuffer) Bytes() []byte {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.truncated {
+		out := make([]byte, 0, b.head.Len()+b.tail.Len())
+		out = append(out, b.head.Bytes()...)
+		out = append(out, b.tail.Bytes()...)
+		return out
+	}
+
+	var out bytes.Buffer
+	out.Write(b.head.Bytes())
+	out.WriteString("\n...[output truncated]...\n")
+	out.Write(b.tail.Bytes())
+	return out.Bytes()
+}
+
 func (e noProgressError) Error() string {
 	return fmt.Sprintf("command killed after %s of no activity", e.timeout)
 }
@@ -195,12 +571,42 @@ func (e killCmdError) Error() string {
 	return fmt.Sprintf("error killing command: %s", e.err)
 }
 
+// defaultVCSConcurrency bounds how many VCS subprocesses runFromCwd and
+// runFromRepoDir will let run at once. It's expected that a future
+// SourceManagerConfig.MaxVCSConcurrency option will let callers override
+// this via setVCSConcurrency; for now it's a fixed, conservative default.
+const defaultVCSConcurrency = 8
+
+// vcsPool holds the *wpool.Pool shared by runFromCwd and runFromRepoDir.
+// It's stored in an atomic.Value, rather than a plain var, because
+// setVCSConcurrency can replace it while other goroutines are concurrently
+// reading it to submit VCS commands.
+var vcsPool atomic.Value
+
+func init() {
+	vcsPool.Store(wpool.New(defaultVCSConcurrency))
+}
+
+func currentVCSPool() *wpool.Pool {
+	return vcsPool.Load().(*wpool.Pool)
+}
+
+// setVCSConcurrency replaces the shared VCS worker pool with one sized to
+// concurrency. Nothing in this package calls it, and there is no
+// SourceManager configuration that sets it, so the pool stays at
+// defaultVCSConcurrency.
+func setVCSConcurrency(concurrency int) {
+	old := currentVCSPool()
+	vcsPool.Store(wpool.New(concurrency))
+	old.Close()
+}
+
 func runFromCwd(ctx context.Context, cmd string, args ...string) ([]byte, error) {
 	c := newMonitoredCmd(exec.Command(cmd, args...), 2*time.Minute)
-	return c.combinedOutput(ctx)
+	return c.combinedOutputPooled(ctx, currentVCSPool())
 }
 
 func runFromRepoDir(ctx context.Context, repo vcs.Repo, cmd string, args ...string) ([]byte, error) {
 	c := newMonitoredCmd(repo.CmdFromDir(cmd, args...), 2*time.Minute)
-	return c.combinedOutput(ctx)
+	return c.combinedOutputPooled(ctx, currentVCSPool())
 }
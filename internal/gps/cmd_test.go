@@ -0,0 +1,148 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gps
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestActivityBufferBytes(t *testing.T) {
+	t.Run("under maxBuffer passes through untouched", func(t *testing.T) {
+		b := newActivityBuffer(20)
+		if _, err := b.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b.Bytes()), "hello"; got != want {
+			t.Fatalf("Bytes() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("over maxBuffer keeps head and tail, drops the middle", func(t *testing.T) {
+		b := newActivityBuffer(10) // headCap=5, tailCap=5
+		if _, err := b.Write([]byte("0123456789ABCDEFGHIJ")); err != nil {
+			t.Fatal(err)
+		}
+		want := "01234\n...[output truncated]...\nFGHIJ"
+		if got := string(b.Bytes()); got != want {
+			t.Fatalf("Bytes() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("truncation math holds across multiple Write calls", func(t *testing.T) {
+		b := newActivityBuffer(10)
+		for _, chunk := range []string{"01", "2345", "6789", "ABCDEF", "GHIJ"} {
+			if _, err := b.Write([]byte(chunk)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := "01234\n...[output truncated]...\nFGHIJ"
+		if got := string(b.Bytes()); got != want {
+			t.Fatalf("Bytes() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("maxBuffer <= 0 is unbounded", func(t *testing.T) {
+		b := newActivityBuffer(0)
+		big := bytes.Repeat([]byte("x"), 1000)
+		if _, err := b.Write(big); err != nil {
+			t.Fatal(err)
+		}
+		if got := b.Bytes(); !bytes.Equal(got, big) {
+			t.Fatalf("Bytes() returned %d bytes, want %d untruncated", len(got), len(big))
+		}
+	})
+}
+
+func TestStreamWriterEmitLinesCarriesPartialLines(t *testing.T) {
+	events := make(chan ProgressEvent, 10)
+	w := &streamWriter{buf: newActivityBuffer(0), stream: "stdout", events: events}
+
+	// "hello" arrives split across two Writes, with no newline in the first;
+	// it must not be emitted until the newline shows up in the second.
+	w.Write([]byte("hel"))
+	select {
+	case ev := <-events:
+		t.Fatalf("got premature event for incomplete line: %+v", ev)
+	default:
+	}
+	w.Write([]byte("lo\nworld\r\n"))
+	w.Write([]byte("partial"))
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-events:
+			got = append(got, ev.Line)
+		default:
+			t.Fatalf("expected 2 events, only got %d", len(got))
+		}
+	}
+	if want := []string{"hello", "world"}; !equalStrings(got, want) {
+		t.Fatalf("got lines %v, want %v", got, want)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event for still-pending partial line: %+v", ev)
+	default:
+	}
+
+	// Completing the partial line should emit exactly it, with the carried
+	// prefix intact.
+	w.Write([]byte(" line\n"))
+	select {
+	case ev := <-events:
+		if ev.Line != "partial line" {
+			t.Fatalf("got line %q, want %q", ev.Line, "partial line")
+		}
+	default:
+		t.Fatal("expected an event for the completed partial line, got none")
+	}
+}
+
+func TestStreamWriterEmitLinesDropsOnFullChannel(t *testing.T) {
+	events := make(chan ProgressEvent, 1)
+	w := &streamWriter{buf: newActivityBuffer(0), stream: "stdout", events: events}
+
+	// Nothing drains events as these lines arrive, so only the first fits in
+	// the buffered channel; the rest must be dropped rather than blocking
+	// Write (and, with it, the goroutine copying the subprocess's pipe).
+	done := make(chan struct{})
+	go func() {
+		w.Write([]byte("a\nb\nc\nd\n"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Write blocked on a full events channel instead of dropping")
+	}
+
+	if n := len(events); n != 1 {
+		t.Fatalf("events channel has %d buffered events, want exactly 1", n)
+	}
+	if ev := <-events; ev.Line != "a" {
+		t.Fatalf("got surviving event %q, want %q", ev.Line, "a")
+	}
+
+	// The activityBuffer backing Write isn't subject to the same dropping:
+	// all four lines must still be there.
+	if got, want := string(w.buf.Bytes()), "a\nb\nc\nd\n"; got != want {
+		t.Fatalf("buf.Bytes() = %q, want %q", got, want)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
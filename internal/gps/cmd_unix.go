@@ -0,0 +1,65 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package gps
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// defaultInterruptSignal is the signal sent to ask a monitored subprocess to
+// shut down gracefully before its KillDelay elapses and it is forcibly
+// killed.
+var defaultInterruptSignal os.Signal = os.Interrupt
+
+// configureProcessGroup sets cmd up so that it becomes the leader of a new
+// process group, letting signalProcessGroup and killProcess reach any helper
+// processes (ssh, askpass, credential helpers) it spawns along the way. It
+// must be called before cmd.Start().
+func configureProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// attachProcessGroup is a no-op on Unix: Setpgid in configureProcessGroup
+// already puts cmd's process in its own group at fork time, so there's
+// nothing left to do once it's running. It exists only so that cmd.go can
+// call it uniformly across platforms; Windows uses it to assign the process
+// to a Job Object once its pid is known.
+func attachProcessGroup(cmd *exec.Cmd) {}
+
+// releaseProcessGroup is a no-op on Unix: process groups don't hold any
+// resource that needs releasing once cmd has finished. It exists only for
+// symmetry with Windows, where it closes the Job Object handle.
+func releaseProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup sends sig to every process in cmd's process group. cmd
+// must have been started with configureProcessGroup applied.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return cmd.Process.Signal(sig)
+	}
+	// A negative pid signals the whole process group rather than just the
+	// group leader.
+	return syscall.Kill(-cmd.Process.Pid, s)
+}
+
+// killProcess forcibly terminates cmd. If group is true, it kills the whole
+// process group rather than just the immediate child, falling back to
+// killing only the child if the group kill fails.
+func killProcess(cmd *exec.Cmd, group bool) error {
+	if group {
+		if err := signalProcessGroup(cmd, syscall.SIGKILL); err == nil {
+			return nil
+		}
+	}
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package gps
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMonitoredCmdKillsProcessGroup verifies that a progress-timeout kill
+// reaps not just the monitored command itself, but also a child process it
+// forked, rather than leaving that child orphaned.
+func TestMonitoredCmdKillsProcessGroup(t *testing.T) {
+	// Fork a long-lived sleep, print its pid so the test can check on it,
+	// then wait on it like a shell normally would while a command runs.
+	script := `
+sleep 30 &
+echo $!
+wait
+`
+	cmd := exec.Command("sh", "-c", script)
+	mc := newMonitoredCmd(cmd, 50*time.Millisecond)
+	mc.KillDelay = 10 * time.Millisecond
+
+	out, err := mc.combinedOutput(context.Background())
+	if err == nil {
+		t.Fatal("expected monitoredCmd to report a progress-timeout error, got nil")
+	}
+
+	childPID := parseChildPID(t, out)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if err := syscall.Kill(childPID, 0); err != nil {
+			// The signal delivery itself failed (ESRCH): the child is gone.
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("child process %d was not reaped after the process group was killed", childPID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestMonitoredCmdEscalatesToSIGKILL verifies waitOrStop's graceful-then-hard
+// escalation: a process group that ignores the interrupt signal outright
+// must be left running for KillDelay before it's hit with SIGKILL, rather
+// than being killed immediately. Without that grace period (or without the
+// SIGKILL escalation itself), this test's child would either die instantly
+// on the interrupt or never die at all.
+func TestMonitoredCmdEscalatesToSIGKILL(t *testing.T) {
+	// Ignoring SIGINT in the shell before forking means the forked sleep
+	// inherits that ignore disposition too (unlike caught signals, which
+	// reset to default across exec, an ignored disposition is preserved),
+	// so neither the shell nor its child reacts to the interrupt waitOrStop
+	// sends; only the later SIGKILL can bring them down.
+	script := `
+trap '' INT
+sleep 30 &
+echo $!
+wait
+`
+	cmd := exec.Command("sh", "-c", script)
+	mc := newMonitoredCmd(cmd, 50*time.Millisecond)
+	mc.KillDelay = 200 * time.Millisecond
+
+	start := time.Now()
+	out, err := mc.combinedOutput(context.Background())
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("expected monitoredCmd to report a progress-timeout error, got nil")
+	}
+	if elapsed < mc.KillDelay {
+		t.Fatalf("monitoredCmd returned after %s, before KillDelay (%s) elapsed; the interrupt must have killed the group immediately instead of being ignored", elapsed, mc.KillDelay)
+	}
+	if elapsed > mc.KillDelay+2*time.Second {
+		t.Fatalf("monitoredCmd took %s to return, far longer than KillDelay (%s); SIGKILL escalation may not have happened", elapsed, mc.KillDelay)
+	}
+
+	childPID := parseChildPID(t, out)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if err := syscall.Kill(childPID, 0); err != nil {
+			// The signal delivery itself failed (ESRCH): the child is gone.
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("child process %d was not reaped by SIGKILL escalation", childPID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func parseChildPID(t *testing.T, out []byte) int {
+	t.Helper()
+	line := out
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(line)))
+	if err != nil {
+		t.Fatalf("could not parse child pid out of output %q: %v", out, err)
+	}
+	return pid
+}
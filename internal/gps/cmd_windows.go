@@ -0,0 +1,204 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package gps
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// windowsInterruptSignal is a sentinel os.Signal used as the default
+// InterruptSignal on Windows, where os.Interrupt cannot actually be delivered
+// to an arbitrary process. Sending it is a no-op, and os.Process.Signal
+// rejects every signal but os.Kill on this platform, so waitOrStop's sigErr
+// is always non-nil here: the KillDelay grace period is never entered and
+// every stop escalates straight to a hard kill. There is no grace period on
+// Windows today, despite KillDelay being configured.
+type windowsInterruptSignal struct{}
+
+func (windowsInterruptSignal) Signal() {}
+
+func (windowsInterruptSignal) String() string { return "interrupt" }
+
+var defaultInterruptSignal os.Signal = windowsInterruptSignal{}
+
+var (
+	modkernel32                  = syscall.NewLazyDLL("kernel32.dll")
+	procCreateJobObjectW         = modkernel32.NewProc("CreateJobObjectW")
+	procSetInformationJobObject  = modkernel32.NewProc("SetInformationJobObject")
+	procAssignProcessToJobObject = modkernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = modkernel32.NewProc("TerminateJobObject")
+	procOpenProcess              = modkernel32.NewProc("OpenProcess")
+)
+
+const (
+	jobObjectExtendedLimitInformation = 9
+	jobObjectLimitKillOnJobClose      = 0x00002000
+
+	processTerminate = 0x0001
+	processSetQuota  = 0x0100
+)
+
+// jobobjectBasicLimitInformation and jobobjectExtendedLimitInformation mirror
+// the Win32 JOBOBJECT_BASIC_LIMIT_INFORMATION / JOBOBJECT_EXTENDED_LIMIT_INFORMATION
+// structs. Only LimitFlags is ever set; the rest of the fields exist so the
+// struct has the layout and size SetInformationJobObject expects.
+type jobobjectBasicLimitInformation struct {
+	PerProcessUserTimeLimit int64
+	PerJobUserTimeLimit     int64
+	LimitFlags              uint32
+	MinimumWorkingSetSize   uintptr
+	MaximumWorkingSetSize   uintptr
+	ActiveProcessLimit      uint32
+	Affinity                uintptr
+	PriorityClass           uint32
+	SchedulingClass         uint32
+}
+
+type ioCounters struct {
+	ReadOperationCount  uint64
+	WriteOperationCount uint64
+	OtherOperationCount uint64
+	ReadTransferCount   uint64
+	WriteTransferCount  uint64
+	OtherTransferCount  uint64
+}
+
+type jobobjectExtendedLimitInformation struct {
+	BasicLimitInformation jobobjectBasicLimitInformation
+	IoInfo                ioCounters
+	ProcessMemoryLimit    uintptr
+	JobMemoryLimit        uintptr
+	PeakProcessMemoryUsed uintptr
+	PeakJobMemoryUsed     uintptr
+}
+
+// jobs maps a started *exec.Cmd to the Job Object its process was assigned
+// to, so attachProcessGroup, killProcess, and releaseProcessGroup can find it
+// without threading a handle through monitoredCmd.
+var (
+	jobsMu sync.Mutex
+	jobs   = map[*exec.Cmd]syscall.Handle{}
+)
+
+// configureProcessGroup creates a Job Object with
+// JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE set, so that killProcess can tear down
+// cmd's process along with any helper processes (ssh, askpass, credential
+// managers) it spawns, mirroring the Unix process-group behavior. It must be
+// called before cmd.Start(); the process itself isn't assigned to the job
+// until attachProcessGroup runs afterward, once cmd.Process exists.
+//
+// There's an unavoidable gap between Start() returning and
+// attachProcessGroup's AssignProcessToJobObject call, during which a child
+// that has already spawned a grandchild of its own lets that grandchild
+// escape the job. Closing that gap requires creating the process suspended
+// and resuming it only after assignment, which os/exec doesn't support: it
+// doesn't expose the thread handle CREATE_SUSPENDED would need resumed. That
+// leaves a narrow race instead of none, but it's still a large improvement
+// over tracking no child processes at all.
+//
+// If any step here fails, cmd falls back to having no job: killProcess will
+// then only reach the immediate child, same as before Job Object support
+// existed.
+func configureProcessGroup(cmd *exec.Cmd) {
+	h, _, _ := procCreateJobObjectW.Call(0, 0)
+	if h == 0 {
+		return
+	}
+	handle := syscall.Handle(h)
+
+	var info jobobjectExtendedLimitInformation
+	info.BasicLimitInformation.LimitFlags = jobObjectLimitKillOnJobClose
+	ret, _, _ := procSetInformationJobObject.Call(
+		uintptr(handle),
+		jobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)),
+		unsafe.Sizeof(info),
+	)
+	if ret == 0 {
+		syscall.CloseHandle(handle)
+		return
+	}
+
+	jobsMu.Lock()
+	jobs[cmd] = handle
+	jobsMu.Unlock()
+}
+
+// attachProcessGroup assigns cmd's now-running process to the Job Object
+// configureProcessGroup created for it, if any. It must be called after
+// cmd.Start() succeeds.
+func attachProcessGroup(cmd *exec.Cmd) {
+	jobsMu.Lock()
+	handle, ok := jobs[cmd]
+	jobsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	// If the process can't be assigned, drop the job, so killProcess falls
+	// back to killing the child instead of terminating an empty job.
+	ph, _, _ := procOpenProcess.Call(uintptr(processTerminate|processSetQuota), 0, uintptr(cmd.Process.Pid))
+	if ph == 0 {
+		releaseProcessGroup(cmd)
+		return
+	}
+	procHandle := syscall.Handle(ph)
+	defer syscall.CloseHandle(procHandle)
+
+	if ret, _, _ := procAssignProcessToJobObject.Call(uintptr(handle), uintptr(procHandle)); ret == 0 {
+		releaseProcessGroup(cmd)
+	}
+}
+
+// releaseProcessGroup closes cmd's Job Object handle, if it has one. It must
+// be called exactly once cmd is done with it, whether that's because
+// cmd.Start failed (configureProcessGroup may have already created the job
+// before the failure), or because cmd.Wait has returned, having exited on
+// its own or been killed.
+func releaseProcessGroup(cmd *exec.Cmd) {
+	jobsMu.Lock()
+	handle, ok := jobs[cmd]
+	if ok {
+		delete(jobs, cmd)
+	}
+	jobsMu.Unlock()
+	if ok {
+		syscall.CloseHandle(handle)
+	}
+}
+
+// signalProcessGroup signals cmd's immediate process. There's no way to
+// deliver an arbitrary os.Signal to every process in a Job Object the way
+// signalProcessGroup's Unix counterpart does with a negative pid; reaching
+// the whole job on a stop requires killProcess's TerminateJobObject path
+// instead.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	return cmd.Process.Signal(sig)
+}
+
+// killProcess forcibly terminates cmd. If group is true and cmd's process
+// was assigned to a Job Object by configureProcessGroup/attachProcessGroup,
+// it terminates the whole job, taking any helper processes it spawned down
+// with it; otherwise, or if the job can't be reached, it falls back to
+// killing only the immediate child.
+func killProcess(cmd *exec.Cmd, group bool) error {
+	if group {
+		jobsMu.Lock()
+		handle, ok := jobs[cmd]
+		jobsMu.Unlock()
+		if ok {
+			if ret, _, _ := procTerminateJobObject.Call(uintptr(handle), 1); ret != 0 {
+				return nil
+			}
+		}
+	}
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package wpool implements a small, bounded worker pool for running VCS
+// subprocesses.
+//
+// Without it, each call into gps's cmd.go spawns its own Wait() goroutine;
+// under a manifest with dozens of projects, `dep ensure` can end up with
+// hundreds of git/hg processes and goroutines all running at once,
+// overwhelming disk I/O and remote rate limits in the process. A Pool caps
+// how many VCS subprocesses run concurrently and reuses a fixed set of
+// worker goroutines across submissions instead of spinning up new ones.
+package wpool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultTickInterval is the period at which each task's progress-timeout
+// polling ticker fires.
+const defaultTickInterval = 100 * time.Millisecond
+
+// errPoolClosed is returned by Submit once the Pool has been closed.
+var errPoolClosed = errors.New("wpool: pool is closed")
+
+// Task is a unit of work submitted to a Pool.
+type Task struct {
+	// Ctx is the context governing the task's lifetime. The pool does not
+	// start the task if Ctx is already done.
+	Ctx context.Context
+	// Deadline, if non-zero, bounds how long the pool will let the task run
+	// regardless of what Ctx allows, as a backstop against runaway
+	// subprocesses. The worker derives a child of Ctx with this deadline and
+	// passes it to Run.
+	Deadline time.Time
+	// Run does the actual work. It's handed the (possibly deadline-bounded)
+	// context to run under, and a channel ticking at the pool's configured
+	// interval for it to use for progress-timeout polling.
+	Run func(ctx context.Context, tick <-chan time.Time) error
+}
+
+// Pool runs submitted Tasks on a fixed-size set of long-lived worker
+// goroutines.
+type Pool struct {
+	tasks        chan submission
+	tickInterval time.Duration
+
+	closeOnce sync.Once
+	closeC    chan struct{}
+	wg        sync.WaitGroup
+}
+
+type submission struct {
+	Task
+	done chan<- error
+}
+
+// New creates a Pool with the given number of worker goroutines. A
+// concurrency value less than 1 is treated as 1.
+func New(concurrency int) *Pool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	p := &Pool{
+		tasks:        make(chan submission),
+		tickInterval: defaultTickInterval,
+		closeC:       make(chan struct{}),
+	}
+
+	for i := 0; i < concurrency; i++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+
+	return p
+}
+
+func (p *Pool) worker() {
+	defer p.wg.Done()
+	for {
+		select {
+		case s := <-p.tasks:
+			s.done <- p.runTask(s.Task)
+		case <-p.closeC:
+			return
+		}
+	}
+}
+
+func (p *Pool) runTask(t Task) error {
+	ctx := t.Ctx
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if !t.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, t.Deadline)
+		defer cancel()
+	}
+
+	// Note that this is a per-task ticker, not one shared pool-wide: a plain
+	// channel send is only ever delivered to a single waiting receiver, so
+	// fanning one ticker out to N concurrently-selecting tasks would only
+	// give each of them a fraction of the ticks, with the effective polling
+	// interval degrading as concurrency rises. A *time.Ticker doesn't cost a
+	// dedicated goroutine of its own - it's serviced by the runtime's timer
+	// machinery - so the ticker adds no goroutine per task. Each monitored
+	// command still starts its own Wait() goroutine; the pool bounds how
+	// many of those exist at once by bounding how many tasks run. Only the
+	// fixed worker goroutines above are actually shared.
+	ticker := time.NewTicker(p.tickInterval)
+	defer ticker.Stop()
+
+	return t.Run(ctx, ticker.C)
+}
+
+// Submit hands t to the next available worker and blocks until it has run.
+// It returns errPoolClosed if the Pool has already been closed, or t.Ctx's
+// error if t.Ctx is done before a worker becomes free, so a caller queued
+// behind a saturated pool doesn't hang past its own cancellation.
+func (p *Pool) Submit(t Task) error {
+	done := make(chan error, 1)
+	select {
+	case p.tasks <- submission{Task: t, done: done}:
+	case <-p.closeC:
+		return errPoolClosed
+	case <-t.Ctx.Done():
+		return t.Ctx.Err()
+	}
+
+	// Once a worker has accepted the submission it always runs it and
+	// reports on done, even if the Pool is closed meanwhile.
+	return <-done
+}
+
+// Close stops the Pool's worker goroutines. It does not wait for or cancel
+// tasks that are already running; it only prevents new ones from being
+// accepted.
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closeC)
+	})
+}
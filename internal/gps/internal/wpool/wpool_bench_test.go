@@ -0,0 +1,112 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wpool
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func noopRun(ctx context.Context, tick <-chan time.Time) error {
+	return nil
+}
+
+// blockingRun returns a Task.Run that blocks until release is closed, so a
+// benchmark can hold b.N tasks in flight at once and sample goroutine counts
+// while they're actually running concurrently, rather than after they've all
+// finished and their goroutines have exited.
+func blockingRun(release <-chan struct{}) func(ctx context.Context, tick <-chan time.Time) error {
+	return func(ctx context.Context, tick <-chan time.Time) error {
+		<-release
+		return nil
+	}
+}
+
+// BenchmarkPool drives b.N tasks through a bounded Pool using a fixed,
+// small set of submitter goroutines that each loop submitting tasks one at
+// a time, rather than one submitter goroutine per task. That's deliberate:
+// a goroutine blocked inside Submit, waiting its turn for a free worker,
+// still counts toward runtime.NumGoroutine() same as any other, so spawning
+// b.N submitters - one per task - would make the reported count track b.N
+// regardless of whether the Pool itself ever runs more than its configured
+// number of workers at once. Keeping the submitter count fixed isolates
+// what the Pool actually bounds: the number of goroutines doing VCS-command
+// work concurrently, which stays at submitters+concurrency however large
+// b.N gets. Contrast with BenchmarkPerCommandGoroutine, whose dedicated
+// per-command goroutines are exactly what the Pool exists to cap.
+func BenchmarkPool(b *testing.B) {
+	const concurrency = 8
+	const submitters = concurrency * 2 // oversubscribed, so no worker idles
+	p := New(concurrency)
+	defer p.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var remaining int64 = int64(b.N)
+	var maxGoroutines int64
+
+	var wg sync.WaitGroup
+	wg.Add(submitters)
+	for i := 0; i < submitters; i++ {
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&remaining, -1) >= 0 {
+				if err := p.Submit(Task{Ctx: context.Background(), Run: noopRun}); err != nil {
+					b.Error(err)
+				}
+				for {
+					g := int64(runtime.NumGoroutine())
+					cur := atomic.LoadInt64(&maxGoroutines)
+					if g <= cur || atomic.CompareAndSwapInt64(&maxGoroutines, cur, g) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	b.StopTimer()
+	b.ReportMetric(float64(maxGoroutines), "goroutines")
+}
+
+// BenchmarkPerCommandGoroutine reproduces the pre-Pool model this package
+// replaces: a dedicated Wait() goroutine spun up per command, with b.N of
+// them running concurrently, for comparison against BenchmarkPool's
+// allocation and goroutine counts under the same load. Unlike BenchmarkPool,
+// every task here gets its own goroutine up front with nothing to bound how
+// many run at once, so the reported goroutine count scales with b.N.
+func BenchmarkPerCommandGoroutine(b *testing.B) {
+	release := make(chan struct{})
+	run := blockingRun(release)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	var inFlight sync.WaitGroup
+	inFlight.Add(b.N)
+	wg.Add(b.N)
+	for i := 0; i < b.N; i++ {
+		go func() {
+			defer wg.Done()
+			inFlight.Done()
+			run(context.Background(), nil)
+		}()
+	}
+
+	inFlight.Wait()
+	goroutines := runtime.NumGoroutine()
+	close(release)
+	wg.Wait()
+
+	b.StopTimer()
+	b.ReportMetric(float64(goroutines), "goroutines")
+}